@@ -5,7 +5,7 @@
 /*
 ftee is a many-to-many file splitter. Command line usage is
 
-	ftee [-h] [-d delimiter] infile1 [infile2 ... ]
+	ftee [-h] [-d delimiter] [-j N] infile1 [infile2 ... ]
 
 The default delimiter is "FTEE".
 */
@@ -13,12 +13,17 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 )
 
 const copyright = `
@@ -79,10 +84,309 @@ const description = `
 	  /* FTEE somefile otherfile */
 
 	ftee has not been tested on Windows. Problems with backslashed filepaths
-	are likely.`
+	are likely.
 
-// Global map of output filenames and file objects.
-var _gOutputs = make(map[string]*os.File)
+	INPUT FROM STDIN
+	If no input files are given, or a filename is "-", ftee reads from
+	standard input instead. This lets ftee sit in the middle of a pipeline,
+	e.g. "generate-report | ftee".
+
+	SUBPROCESS TARGETS
+	A target token that begins with "|" is run as a shell command instead
+	of a file. The remainder of the line up to the next "|" token (or the
+	end of the line) is the command. ftee starts the command and writes
+	the section's lines to its stdin, e.g.:
+
+	  FTEE out.log |gzip -c >out.gz |grep ERROR >errors.txt
+
+	WRITE MODES
+	By default, a file target is truncated the first time it's opened, as
+	described above. The -a flag changes that default to append for the
+	rest of the run. Either way, a single target in a directive line can
+	override the current default by prefixing its name:
+
+	  >name   always truncate name, regardless of -a
+	  >>name  always append to name, regardless of -a
+	  +name   open name only if it already exists; error if it doesn't
+
+	  FTEE >trunc.txt >>append.log +existing.txt
+
+	A target is identified by its resolved absolute path, so "out.txt" and
+	"./out.txt" refer to the same open file. Naming the same target twice
+	with conflicting write modes is an error.
+
+	SUSPENDING OUTPUT
+	A directive line whose only argument is the end tag (default
+	"--end", overridable with -e) clears the current targets instead of
+	naming new ones, so following lines are dropped until the next
+	directive line:
+
+	  FTEE out.txt
+	  This goes into out.txt.
+	  FTEE --end
+	  This is narrative text and goes nowhere.
+	  FTEE out.txt
+	  This goes into out.txt too.
+
+	This lets a single source file interleave narrative prose with fenced
+	output blocks, literate-programming style, without the prose leaking
+	into the last-named target.
+
+	PARALLEL INPUT PROCESSING
+	The -j flag bounds how many input files ftee scans concurrently
+	(default 1, i.e. one at a time, as above). Every output target is
+	still written by exactly one goroutine, so lines from concurrent
+	input files are never interleaved mid-line, but lines from different
+	input files destined for the same target may arrive in either order.
+	If any input file fails, the rest are cancelled, their output targets
+	are closed, and all output files are removed, the same as a
+	single-input failure.
+
+	PARENT DIRECTORIES AND DIRECTORY-TREE TARGETS
+	By default, a file target fails to open if its parent directory
+	doesn't exist. The -p flag makes ftee create missing parent
+	directories instead, the way "mkdir -p" would. On error, any
+	directory ftee created this way is removed along with the output
+	files; directories that already existed are left alone.
+
+	A target ending in "/" is a directory rather than a file: each
+	directive line that names it writes its section to a new auto-named
+	file inside that directory, e.g. "section-0001.txt", incrementing by
+	one per directive line that names the directory, e.g.:
+
+	  FTEE out/
+	  This goes into out/section-0001.txt.
+	  FTEE out/
+	  This goes into out/section-0002.txt.
+
+	A directory-tree target follows the same -p rule as any other target:
+	the directory itself must already exist unless -p is given.
+
+	FILTER PIPELINES
+	The field right after the delimiter may name a filter command instead
+	of a target, by prefixing it with "!". The section's lines are piped
+	through that command and its output, not the section itself, is what's
+	written to the targets that follow:
+
+	  FTEE !gofmt out.go
+	  func main(){println("hi")}
+
+	A filter command containing spaces must be quoted so it stays one
+	field, e.g.:
+
+	  FTEE !"sed s/foo/bar/" a.txt b.txt
+
+	The filter's stdin is closed, and its exit status collected, when the
+	next directive line (or end of file) is reached; a non-zero exit is an
+	error, the same as a failed subprocess target.`
+
+// writeMode says how a file target should be opened.
+type writeMode int
+
+const (
+	// modeDefault defers to the -a flag's current setting.
+	modeDefault writeMode = iota
+	modeTruncate
+	modeAppend
+	// modeExistsOnly opens the target only if it already exists, appending
+	// to its current content.
+	modeExistsOnly
+)
+
+// outputTarget is a single destination parsed from a directive line: either
+// a file name (with an optional write-mode override) or, for names
+// beginning with "|", a subprocess command.
+type outputTarget struct {
+	name string
+	mode writeMode
+}
+
+// targetWriter owns a single output target's underlying writer. Exactly one
+// goroutine (run) ever touches that writer, so producer goroutines scanning
+// different input files concurrently (see the -j flag) can feed it lines
+// without their writes interleaving mid-line.
+type targetWriter struct {
+	writer    io.WriteCloser
+	lines     chan string
+	errCh     chan error
+	doneCh    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// newTargetWriter starts w's owner goroutine and returns the targetWriter
+// producers use to queue lines for it.
+func newTargetWriter(w io.WriteCloser) *targetWriter {
+	tw := &targetWriter{
+		writer: w,
+		lines:  make(chan string, 16),
+		errCh:  make(chan error, 1),
+		doneCh: make(chan struct{}),
+	}
+	go tw.run()
+	return tw
+}
+
+// run serializes every write to the target until its lines channel is
+// closed, then exits after draining whatever lines were already queued.
+func (tw *targetWriter) run() {
+	defer close(tw.doneCh)
+	for line := range tw.lines {
+		if _, err := io.WriteString(tw.writer, line); err != nil {
+			select {
+			case tw.errCh <- err:
+			default:
+			}
+		}
+	}
+}
+
+// write queues line for tw's owner goroutine. It returns ctx's error instead
+// of blocking forever if ctx is cancelled before the line can be queued.
+func (tw *targetWriter) write(ctx context.Context, line string) error {
+	select {
+	case tw.lines <- line:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops tw's owner goroutine, draining any lines still queued, then
+// closes the underlying writer. It reports the target's first write error,
+// if any, in preference to an error from closing the writer. close is
+// idempotent: later calls just replay the first call's result, so a target
+// that outlives several closeOutputFiles calls (as happens in tests) isn't
+// closed twice.
+func (tw *targetWriter) close() error {
+	tw.closeOnce.Do(func() {
+		close(tw.lines)
+		<-tw.doneCh
+		cerr := tw.writer.Close()
+		select {
+		case werr := <-tw.errCh:
+			tw.closeErr = werr
+		default:
+			tw.closeErr = cerr
+		}
+	})
+	return tw.closeErr
+}
+
+// sectionFilter runs a section's content through a shell command before it
+// reaches the section's targets, per a directive's "!command" field. Unlike
+// a "|" subprocess target, a filter isn't itself a target: its stdout is
+// distributed to the targets named on the same directive line via their own
+// targetWriters, so writes from the filter's draining goroutine are
+// serialized the same way writes from processInputFile are. Its stdin pipe
+// is itself owned by a targetWriter, so feeding it lines is ctx-aware and a
+// broken pipe (the filter having already exited) is reported through close,
+// not as an immediate write error, the same as any other target. A
+// sectionFilter is local to the processInputFile call that started it;
+// unlike _gOutputs, it isn't shared across concurrently processed input
+// files.
+type sectionFilter struct {
+	cmd    *exec.Cmd
+	stdin  *targetWriter
+	doneCh chan error
+}
+
+// startSectionFilter starts command via "sh -c", piping its stdout to
+// targets (the section's own output targets) a line at a time as it's
+// produced, and returns a sectionFilter whose stdin accepts the section's
+// input lines.
+func startSectionFilter(ctx context.Context, command string, targets []*targetWriter) (*sectionFilter, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		reader := bufio.NewReader(stdout)
+		for {
+			out, rerr := reader.ReadString('\n')
+			if len(out) > 0 {
+				for _, tw := range targets {
+					tw.write(ctx, out)
+				}
+			}
+			if rerr != nil {
+				break
+			}
+		}
+		done <- cmd.Wait()
+	}()
+	return &sectionFilter{cmd: cmd, stdin: newTargetWriter(stdin), doneCh: done}, nil
+}
+
+// write queues line as input to the filter command. Like targetWriter.write,
+// it only reports ctx's error if ctx is cancelled before the line can be
+// queued; a failure writing to the filter (e.g. because it already exited)
+// surfaces from close instead.
+func (sf *sectionFilter) write(ctx context.Context, line string) error {
+	return sf.stdin.write(ctx, line)
+}
+
+// close closes the filter's stdin, so it sees EOF, then waits for its
+// output to finish draining to the section's targets and for the command
+// itself to exit. A non-zero exit, or a failure writing to the filter's
+// stdin, is reported as an error.
+func (sf *sectionFilter) close() error {
+	werr := sf.stdin.close()
+	err := <-sf.doneCh
+	if err != nil {
+		return fmt.Errorf("filter %q: %w", sf.cmd.Args, err)
+	}
+	if werr != nil {
+		return fmt.Errorf("filter %q: %w", sf.cmd.Args, werr)
+	}
+	return nil
+}
+
+// _gMu guards _gOutputs, _gProcesses and _gModes. openOutputFiles may be
+// called concurrently by one goroutine per input file (see the -j flag), so
+// all access to these maps must hold it.
+var _gMu sync.Mutex
+
+// Global map of resolved output target keys (absolute file paths, or the
+// raw command for subprocess targets) to the goroutine-owned writer that
+// serializes writes to them.
+var _gOutputs = make(map[string]*targetWriter)
+
+// Global map of target names to the subprocesses backing them, so their
+// exit status can be collected once their stdin pipe is closed.
+var _gProcesses = make(map[string]*exec.Cmd)
+
+// Global map recording the write mode each open target was opened with, so
+// that re-opening it with a conflicting mode can be reported as an error.
+var _gModes = make(map[string]writeMode)
+
+// _gAppendDefault holds the -a flag's value: the write mode used for file
+// targets that don't specify their own override.
+var _gAppendDefault bool
+
+// _gMkdirs holds the -p flag's value: whether openOutputFiles creates a
+// target's parent directories (or a directory-tree target itself) instead
+// of failing when they don't already exist.
+var _gMkdirs bool
+
+// Global set of directories ftee itself created while honoring -p, each
+// keyed by the topmost directory that didn't already exist. removeOutputFiles
+// removes these on error but leaves any pre-existing directory alone.
+var _gCreatedDirs = make(map[string]bool)
+
+// Global map from a directory-tree target's absolute path to the number of
+// auto-named section files written into it so far.
+var _gSectionCounters = make(map[string]int)
 
 func main() {
 	// Ensure we exit with an error code and log message
@@ -90,36 +394,77 @@ func main() {
 	// Credit: https://tinyurl.com/ycv9zpbn
 	var err error
 	defer func() {
+		// Close any opened output files and subprocess pipes, collecting
+		// the first error from either a write target or a failed
+		// subprocess, before deciding whether to fail.
+		if cerr := closeOutputFiles(); cerr != nil && err == nil {
+			err = cerr
+		}
 		if err != nil {
 			removeOutputFiles()
 			log.Fatalln(err)
 		}
 	}()
 
-	// Close any opened output files on exit.
-	defer closeOutputFiles()
-
 	// Parse command line
 	flag.Usage = usage
 	var delimiter string
+	var endTag string
+	var jobs int
 	flag.StringVar(&delimiter, "d", "FTEE", "the delimiter tag")
+	flag.StringVar(&endTag, "e", "--end", "the end-of-output directive")
+	flag.BoolVar(&_gAppendDefault, "a", false, "append to file targets instead of truncating them")
+	flag.BoolVar(&_gMkdirs, "p", false, "create a target's parent directories (or a directory-tree target) if missing")
+	flag.IntVar(&jobs, "j", 1, "number of input files to scan concurrently")
 	flag.Parse()
 	infiles := flag.Args()
+	if len(infiles) == 0 {
+		infiles = []string{"-"}
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
 
-	// Process all the input files
-	var infd *os.File
+	// Process the input files, at most jobs of them at once. Any failure
+	// cancels ctx so the remaining goroutines stop promptly.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	errs := make(chan error, len(infiles))
 	for _, infname := range infiles {
-		infd, err = os.Open(infname)
-		if err != nil {
-			err = fmt.Errorf("Couldn't open input file: %q", err)
-			return
-		}
-		err = processInputFile(infd, delimiter)
-		// Note: processInputFile handles closing the file.
-		if err != nil {
-			err = fmt.Errorf("Error processing %s: %q", infname, err)
-			return
-		}
+		infname := infname
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var infd *os.File
+			var ferr error
+			if infname == "-" {
+				infd = os.Stdin
+			} else if infd, ferr = os.Open(infname); ferr != nil {
+				errs <- fmt.Errorf("Couldn't open input file: %q", ferr)
+				cancel()
+				return
+			}
+			// Note: processInputFile handles closing infd.
+			if ferr = processInputFile(ctx, infd, delimiter, endTag); ferr != nil {
+				errs <- fmt.Errorf("Error processing %s: %q", infname, ferr)
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	// Every input file can fail for its own, unrelated reason, so report
+	// all of them instead of silently keeping only the first.
+	var all []error
+	for ferr := range errs {
+		all = append(all, ferr)
+	}
+	if len(all) > 0 {
+		err = errors.Join(all...)
 	}
 }
 
@@ -136,17 +481,41 @@ func usage() {
 // delimiter, it returns an empty slice and a nil error to indicate that this
 // line is to be output to whatever file targets are currently in effect.
 // Otherwise it splits the line on whitespace. Each field after the delimiter
-// is presumed to to be a file name and is appended to the names slice. Non-nil
+// is presumed to to be a target and is appended to the targets slice. Non-nil
 // errors are returned unless the delimiter is found in exactly one field and
 // there is at least on field following it.
-func extractFileNames(delimiter string, line string) (names []string, err error) {
+//
+// The field immediately after the delimiter may instead begin with "!",
+// naming a filter command rather than a target: the section's lines are run
+// through that command and its output, not the section itself, is what
+// reaches the targets. A filter command containing whitespace must be
+// quoted, e.g. !"sed s/foo/bar/", so it survives the whitespace split as a
+// single field; extractFileNames rejoins quoted fields and returns the
+// command, with its quotes stripped, as filter.
+//
+// A field beginning with "|" starts a subprocess target instead of a file
+// name: it and every following field up to the next "|" field (or the end
+// of the line) are joined with spaces and kept together as a single target
+// of the form "|command args...".
+//
+// A file field may be prefixed with ">" (force truncate), ">>" (force
+// append) or "+" (open only if the file already exists) to override the
+// current -a default for that target; see outputTarget.
+//
+// If endTag is the only field found after the delimiter, extractFileNames
+// returns end = true and an empty, nil-error targets list, signalling that
+// the caller should suspend output rather than treat endTag as a target
+// name.
+func extractFileNames(delimiter string, endTag string, line string) (targets []outputTarget, filter string, end bool, err error) {
 	// Short circuit if line doesn't contain delimiter
 	if !strings.Contains(line, delimiter) {
 		return
 	}
 	fields := strings.Fields(line)
 	dfound := false
-	for _, field := range fields {
+	filterParsed := false
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
 		if !dfound {
 			if field == delimiter {
 				dfound = true
@@ -155,62 +524,246 @@ func extractFileNames(delimiter string, line string) (names []string, err error)
 		}
 		if field == delimiter {
 			err = fmt.Errorf("Found more than one delimiter %s in line.", delimiter)
-			return names, err
+			return nil, "", end, err
+		}
+		if !filterParsed && len(targets) == 0 && strings.HasPrefix(field, "!") {
+			filterParsed = true
+			cmd := field[1:]
+			if strings.HasPrefix(cmd, `"`) && !(len(cmd) > 1 && strings.HasSuffix(cmd, `"`)) {
+				for i+1 < len(fields) {
+					i++
+					cmd += " " + fields[i]
+					if strings.HasSuffix(fields[i], `"`) {
+						break
+					}
+				}
+			}
+			filter = strings.Trim(cmd, `"`)
+			continue
+		}
+		if strings.HasPrefix(field, "|") {
+			targets = append(targets, outputTarget{name: field})
+			continue
 		}
-		names = append(names, field)
+		if len(targets) > 0 && strings.HasPrefix(targets[len(targets)-1].name, "|") {
+			last := &targets[len(targets)-1]
+			last.name += " " + field
+			continue
+		}
+		mode := modeDefault
+		switch {
+		case strings.HasPrefix(field, ">>"):
+			mode = modeAppend
+			field = field[2:]
+		case strings.HasPrefix(field, ">"):
+			mode = modeTruncate
+			field = field[1:]
+		case strings.HasPrefix(field, "+"):
+			mode = modeExistsOnly
+			field = field[1:]
+		}
+		targets = append(targets, outputTarget{name: field, mode: mode})
 	}
 	switch dfound {
 	case false:
 		err = fmt.Errorf("Delimiter %s must be surrounded by whitespace", delimiter)
 	case true:
-		if len(names) == 0 {
+		if len(targets) == 0 {
 			err = fmt.Errorf("No file names found after delimiter %s", delimiter)
+		} else if filter == "" && len(targets) == 1 && targets[0].mode == modeDefault && targets[0].name == endTag {
+			return nil, "", true, nil
 		}
 	}
-	return names, err
+	return targets, filter, end, err
 }
 
-// openOutputFiles is called with results from extractFileNames. For each name
-// in the list, It checks the outputs map to see if the file is already opened.
-// If so, it ignores the name and moves on to the next one.  Otherwise it
-// attempts to open the file for writing, truncating it if it exists. If
-// successful it adds it to outputs map. On failure, it returns the error from
-// os.Create immediately without attempting to open any further files from the
-// names list.
-func openOutputFiles(names []string) error {
-	var err error = nil
-	for _, name := range names {
-		isnew := true
-		for oname, _ := range _gOutputs {
-			if oname == name {
-				isnew = false
-				break
+// targetKey resolves the map key under which a target's writer is tracked in
+// _gOutputs: the raw command line for a subprocess target, or the target's
+// absolute file path otherwise, so that two different spellings of the same
+// path are treated as the same target.
+func targetKey(t outputTarget) (string, error) {
+	if strings.HasPrefix(t.name, "|") {
+		return t.name, nil
+	}
+	return filepath.Abs(t.name)
+}
+
+// ensureDir creates dir and any missing ancestors, as "mkdir -p" would, when
+// the -p flag is set; it's a no-op otherwise or if dir already exists. It
+// records the topmost ancestor it had to create in _gCreatedDirs, so
+// removeOutputFiles can undo exactly what ftee created and nothing that
+// already existed.
+func ensureDir(dir string) error {
+	if !_gMkdirs {
+		return nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	missing := dir
+	for {
+		parent := filepath.Dir(missing)
+		if parent == missing {
+			break
+		}
+		if _, err := os.Stat(parent); err == nil {
+			break
+		}
+		missing = parent
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	_gCreatedDirs[missing] = true
+	return nil
+}
+
+// nextSectionFile returns the next auto-named file inside a directory-tree
+// target (a name ending in "/"), creating the directory first if -p is set.
+func nextSectionFile(dir string) (string, error) {
+	dirAbs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := ensureDir(dirAbs); err != nil {
+		return "", err
+	}
+	_gSectionCounters[dirAbs]++
+	return filepath.Join(dirAbs, fmt.Sprintf("section-%04d.txt", _gSectionCounters[dirAbs])), nil
+}
+
+// openOutputFiles is called with results from extractFileNames. A target
+// name ending in "/" is first resolved, via nextSectionFile, to a new
+// auto-named file inside that directory; the target is mutated in place so
+// the caller's later targetKey lookups see the resolved name. For every
+// other target, openOutputFiles resolves its key (see targetKey) and checks
+// the outputs map to see if that key is already opened. If so, it confirms
+// the target's requested mode matches the mode it was originally opened
+// with, returning an error on a mismatch, and moves on to the next target.
+// Otherwise it opens the target, starts its owner targetWriter, and adds it
+// to the outputs map. On failure, it returns the error immediately without
+// attempting to open any further targets from the list.
+//
+// A name beginning with "|" is started as a subprocess (via "sh -c") instead
+// of opened as a file; its stdin pipe becomes the output target and its
+// stdout/stderr are inherited from ftee so the subprocess behaves the way it
+// would in a shell pipeline. Write modes don't apply to subprocess targets.
+//
+// openOutputFiles may be called concurrently by one goroutine per input
+// file; it holds _gMu for its whole body so concurrent calls can't both open
+// the same new target.
+func openOutputFiles(targets []outputTarget) error {
+	_gMu.Lock()
+	defer _gMu.Unlock()
+	for i := range targets {
+		t := &targets[i]
+		if !strings.HasPrefix(t.name, "|") && strings.HasSuffix(t.name, "/") {
+			name, err := nextSectionFile(t.name)
+			if err != nil {
+				return err
 			}
+			t.name = name
+		}
+		key, err := targetKey(*t)
+		if err != nil {
+			return err
 		}
-		if isnew {
-			fd, err := os.Create(name)
+		if _, exists := _gOutputs[key]; exists {
+			if t.mode != modeDefault && t.mode != _gModes[key] {
+				return fmt.Errorf("target %q already open with a different write mode", t.name)
+			}
+			continue
+		}
+		if strings.HasPrefix(t.name, "|") {
+			cmd := exec.Command("sh", "-c", strings.TrimPrefix(t.name, "|"))
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			pipe, err := cmd.StdinPipe()
 			if err != nil {
 				return err
 			}
-			_gOutputs[name] = fd
+			if err = cmd.Start(); err != nil {
+				return err
+			}
+			_gOutputs[key] = newTargetWriter(pipe)
+			_gProcesses[key] = cmd
+			continue
+		}
+		if err := ensureDir(filepath.Dir(t.name)); err != nil {
+			return err
+		}
+		mode := t.mode
+		if mode == modeDefault {
+			if _gAppendDefault {
+				mode = modeAppend
+			} else {
+				mode = modeTruncate
+			}
 		}
+		var fd *os.File
+		switch mode {
+		case modeTruncate:
+			fd, err = os.Create(t.name)
+		case modeAppend:
+			fd, err = os.OpenFile(t.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		case modeExistsOnly:
+			fd, err = os.OpenFile(t.name, os.O_APPEND|os.O_WRONLY, 0644)
+		}
+		if err != nil {
+			return err
+		}
+		_gOutputs[key] = newTargetWriter(fd)
+		_gModes[key] = mode
 	}
-	return err
+	return nil
 }
 
-// closeOutputFiles is used as a deferred call in main to ensure that all
-// output files are closed on exit.
-func closeOutputFiles() {
-	for _, fd := range _gOutputs {
-		fd.Close()
+// getOutputWriter returns the targetWriter registered for key, which must
+// already have been opened by openOutputFiles.
+func getOutputWriter(key string) *targetWriter {
+	_gMu.Lock()
+	defer _gMu.Unlock()
+	return _gOutputs[key]
+}
+
+// closeOutputFiles is used as a deferred call in main to ensure that every
+// target's owner goroutine is stopped, draining any lines still queued, and
+// its writer closed. Subprocess targets are then waited on so a non-zero
+// exit status can be reported. The first error encountered, from either a
+// write target or a failed subprocess, is returned.
+func closeOutputFiles() error {
+	_gMu.Lock()
+	defer _gMu.Unlock()
+	var err error
+	for key, tw := range _gOutputs {
+		if werr := tw.close(); werr != nil && err == nil {
+			err = fmt.Errorf("target %q: %q", key, werr)
+		}
 	}
+	for name, cmd := range _gProcesses {
+		if werr := cmd.Wait(); werr != nil && err == nil {
+			err = fmt.Errorf("subprocess target %q failed: %q", name, werr)
+		}
+	}
+	return err
 }
 
 // removeOutputFiles is used in main to ensure that all output files are
-// removed if an error has occurred.
+// removed if an error has occurred. Subprocess targets have no file to
+// remove and are skipped. Any directory ftee itself created while honoring
+// -p (see ensureDir) is removed too; directories that already existed are
+// left alone.
 func removeOutputFiles() {
-	for name, _ := range _gOutputs {
-		os.Remove(name)
+	_gMu.Lock()
+	defer _gMu.Unlock()
+	for key := range _gOutputs {
+		if strings.HasPrefix(key, "|") {
+			continue
+		}
+		os.Remove(key)
+	}
+	for dir := range _gCreatedDirs {
+		os.RemoveAll(dir)
 	}
 }
 
@@ -223,17 +776,49 @@ func removeOutputFiles() {
 // succeeds, the files are set as the current output targets for
 // following lines until the next delimiter line is encountered.
 //
+// A directive naming a filter command (see extractFileNames) starts that
+// command instead of writing lines directly to the targets; the filter's
+// own output, not the section's lines, is what reaches them. The filter is
+// stopped, the same as the targets it feeds, once the next directive line
+// or end of file is reached, and a non-zero exit is returned as an error.
+//
+// A directive line whose only argument is endTag clears the current
+// targets instead, so following lines are dropped until the next
+// directive line names new ones.
+//
 // If parsing fails, the error from extractFileNames() is returned.
 // Similarly, processing ends if openOutputFiles() fails.
 // Processing ends normally when all lines in the file have been
-// read and processed.
-func processInputFile(fd *os.File, delimiter string) error {
-	defer fd.Close()
-	var err error = nil
+// read and processed, or early with ctx's error if ctx is cancelled, which
+// happens when another concurrently processed input file (see the -j flag)
+// fails.
+func processInputFile(ctx context.Context, fd *os.File, delimiter string, endTag string) (err error) {
+	if fd != os.Stdin {
+		defer fd.Close()
+	}
 	reader := bufio.NewReader(fd)
-	var targets = make([]*os.File, 0)
+	var targets = make([]*targetWriter, 0)
+	var filter *sectionFilter
+	closeFilter := func() error {
+		if filter == nil {
+			return nil
+		}
+		ferr := filter.close()
+		filter = nil
+		return ferr
+	}
+	defer func() {
+		if ferr := closeFilter(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}()
 	var line string
 	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		line, err = reader.ReadString('\n')
 		if err == io.EOF {
 			err = nil
@@ -242,23 +827,49 @@ func processInputFile(fd *os.File, delimiter string) error {
 		if err != nil {
 			return err
 		}
-		names, err := extractFileNames(delimiter, line)
+		outTargets, filterCmd, end, err := extractFileNames(delimiter, endTag, line)
 		if err != nil {
 			return err
 		}
-		if len(names) == 0 {
-			// lineout := line + "\n"
-			for _, f := range targets {
-				f.WriteString(line)
+		switch {
+		case end:
+			if ferr := closeFilter(); ferr != nil {
+				return ferr
 			}
-		} else {
-			err = openOutputFiles(names)
+			targets = make([]*targetWriter, 0)
+		case len(outTargets) == 0 && filterCmd == "":
+			if filter != nil {
+				if werr := filter.write(ctx, line); werr != nil {
+					return werr
+				}
+				continue
+			}
+			for _, tw := range targets {
+				if werr := tw.write(ctx, line); werr != nil {
+					return werr
+				}
+			}
+		default:
+			if ferr := closeFilter(); ferr != nil {
+				return ferr
+			}
+			err = openOutputFiles(outTargets)
 			if err != nil {
 				return err
 			}
-			targets = make([]*os.File, 0)
-			for _, name := range names {
-				targets = append(targets, _gOutputs[name])
+			targets = make([]*targetWriter, 0)
+			for _, t := range outTargets {
+				key, err := targetKey(t)
+				if err != nil {
+					return err
+				}
+				targets = append(targets, getOutputWriter(key))
+			}
+			if filterCmd != "" {
+				filter, err = startSectionFilter(ctx, filterCmd, targets)
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -1,26 +1,30 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 )
 
 func TestExtractFileNames(t *testing.T) {
 	// Good lines
 	line := "// FTEE foo.bar baz.txt"
-	expected := []string{"foo.bar", "baz.txt"}
-	names, err := extractFileNames("FTEE", line)
+	expected := []outputTarget{{name: "foo.bar"}, {name: "baz.txt"}}
+	names, _, _, err := extractFileNames("FTEE", "--end", line)
 	if err != nil {
 		t.Errorf("Unexpected error \"%q\" parsing \"%s\"", err, line)
 	}
 	if !reflect.DeepEqual(names, expected) {
-		t.Errorf("Expected %s got %s", expected, names)
+		t.Errorf("Expected %v got %v", expected, names)
 	}
 	// Output lines (no FTEE)
 	line = "lorem ipsum sit amet ..."
-	names, err = extractFileNames("FTEE", line)
+	names, _, _, err = extractFileNames("FTEE", "--end", line)
 	if err != nil {
 		t.Errorf("Unexpected error \"%q\" parsing \"%s\"", err, line)
 	}
@@ -28,36 +32,226 @@ func TestExtractFileNames(t *testing.T) {
 	// Bad lines
 	line = "//FTEE foo.bar baz.txt"
 	errexp := fmt.Errorf("Delimiter FTEE must be surrounded by whitespace")
-	names, err = extractFileNames("FTEE", line)
+	names, _, _, err = extractFileNames("FTEE", "--end", line)
 	if !reflect.DeepEqual(err, errexp) {
 		t.Errorf("Expected %q got %q", errexp, err)
 	}
 	line = "// FTEE foo.bar FTEE baz.txt"
 	errexp = fmt.Errorf("Found more than one delimiter FTEE in line.")
-	names, err = extractFileNames("FTEE", line)
+	names, _, _, err = extractFileNames("FTEE", "--end", line)
 	if !reflect.DeepEqual(err, errexp) {
 		t.Errorf("Expected %q got %q", errexp, err)
 	}
 	line = "// FTEE"
 	errexp = fmt.Errorf("No file names found after delimiter FTEE")
-	names, err = extractFileNames("FTEE", line)
+	names, _, _, err = extractFileNames("FTEE", "--end", line)
 	if !reflect.DeepEqual(err, errexp) {
 		t.Errorf("Expected %q got %q", errexp, err)
 	}
 
 }
 
+func TestExtractFileNamesSubprocess(t *testing.T) {
+	line := "// FTEE foo.bar |sort -u >sorted.txt"
+	expected := []outputTarget{{name: "foo.bar"}, {name: "|sort -u >sorted.txt"}}
+	names, _, _, err := extractFileNames("FTEE", "--end", line)
+	if err != nil {
+		t.Errorf("Unexpected error \"%q\" parsing \"%s\"", err, line)
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v got %v", expected, names)
+	}
+}
+
+func TestExtractFileNamesWriteModes(t *testing.T) {
+	line := "// FTEE >trunc.txt >>append.log +existing.txt"
+	expected := []outputTarget{
+		{name: "trunc.txt", mode: modeTruncate},
+		{name: "append.log", mode: modeAppend},
+		{name: "existing.txt", mode: modeExistsOnly},
+	}
+	names, _, _, err := extractFileNames("FTEE", "--end", line)
+	if err != nil {
+		t.Errorf("Unexpected error \"%q\" parsing \"%s\"", err, line)
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v got %v", expected, names)
+	}
+}
+
+func TestExtractFileNamesEnd(t *testing.T) {
+	line := "// FTEE --end"
+	names, _, end, err := extractFileNames("FTEE", "--end", line)
+	if err != nil {
+		t.Errorf("Unexpected error \"%q\" parsing \"%s\"", err, line)
+	}
+	if !end {
+		t.Errorf("Expected end=true parsing \"%s\"", line)
+	}
+	if len(names) != 0 {
+		t.Errorf("Expected no targets parsing \"%s\", got %v", line, names)
+	}
+}
+
+func TestExtractFileNamesFilter(t *testing.T) {
+	line := "// FTEE !gofmt out.go"
+	names, filter, _, err := extractFileNames("FTEE", "--end", line)
+	if err != nil {
+		t.Errorf("Unexpected error \"%q\" parsing \"%s\"", err, line)
+	}
+	if filter != "gofmt" {
+		t.Errorf("Expected filter \"gofmt\" got %q", filter)
+	}
+	expected := []outputTarget{{name: "out.go"}}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v got %v", expected, names)
+	}
+
+	line = `// FTEE !"sed s/foo/bar/" a.txt b.txt`
+	names, filter, _, err = extractFileNames("FTEE", "--end", line)
+	if err != nil {
+		t.Errorf("Unexpected error \"%q\" parsing \"%s\"", err, line)
+	}
+	if filter != "sed s/foo/bar/" {
+		t.Errorf("Expected filter \"sed s/foo/bar/\" got %q", filter)
+	}
+	expected = []outputTarget{{name: "a.txt"}, {name: "b.txt"}}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v got %v", expected, names)
+	}
+}
+
+func TestProcessInputFileEnd(t *testing.T) {
+	content := "FTEE /tmp/ftee_end_test.txt\n" +
+		"kept\n" +
+		"FTEE --end\n" +
+		"dropped\n"
+	tmpin := "/tmp/ftee_end_test_input.txt"
+	if err := os.WriteFile(tmpin, []byte(content), 0644); err != nil {
+		t.Fatalf("Unexpected error writing %q: %q", tmpin, err)
+	}
+	defer os.Remove(tmpin)
+	defer os.Remove("/tmp/ftee_end_test.txt")
+
+	infd, err := os.Open(tmpin)
+	if err != nil {
+		t.Fatalf("Unexpected error opening %q: %q", tmpin, err)
+	}
+	if err = processInputFile(context.Background(), infd, "FTEE", "--end"); err != nil {
+		t.Fatalf("Unexpected error: %q", err)
+	}
+	closeOutputFiles()
+	key, _ := targetKey(outputTarget{name: "/tmp/ftee_end_test.txt"})
+	delete(_gOutputs, key)
+	delete(_gModes, key)
+
+	got, err := os.ReadFile("/tmp/ftee_end_test.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error reading output: %q", err)
+	}
+	if string(got) != "kept\n" {
+		t.Errorf("Expected only \"kept\\n\", got %q", got)
+	}
+}
+
+func TestProcessInputFileFilter(t *testing.T) {
+	content := `FTEE !"tr a-z A-Z" /tmp/ftee_filter_test_out.txt` + "\n" +
+		"hello\n" +
+		"world\n" +
+		"FTEE /tmp/ftee_filter_test_plain.txt\n" +
+		"untouched\n"
+	tmpin := "/tmp/ftee_filter_test_input.txt"
+	if err := os.WriteFile(tmpin, []byte(content), 0644); err != nil {
+		t.Fatalf("Unexpected error writing %q: %q", tmpin, err)
+	}
+	defer os.Remove(tmpin)
+	defer os.Remove("/tmp/ftee_filter_test_out.txt")
+	defer os.Remove("/tmp/ftee_filter_test_plain.txt")
+
+	infd, err := os.Open(tmpin)
+	if err != nil {
+		t.Fatalf("Unexpected error opening %q: %q", tmpin, err)
+	}
+	if err = processInputFile(context.Background(), infd, "FTEE", "--end"); err != nil {
+		t.Fatalf("Unexpected error: %q", err)
+	}
+	closeOutputFiles()
+	for _, name := range []string{"/tmp/ftee_filter_test_out.txt", "/tmp/ftee_filter_test_plain.txt"} {
+		key, _ := targetKey(outputTarget{name: name})
+		delete(_gOutputs, key)
+		delete(_gModes, key)
+	}
+
+	got, err := os.ReadFile("/tmp/ftee_filter_test_out.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error reading output: %q", err)
+	}
+	if string(got) != "HELLO\nWORLD\n" {
+		t.Errorf("Expected \"HELLO\\nWORLD\\n\", got %q", got)
+	}
+	got, err = os.ReadFile("/tmp/ftee_filter_test_plain.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error reading output: %q", err)
+	}
+	if string(got) != "untouched\n" {
+		t.Errorf("Expected \"untouched\\n\", got %q", got)
+	}
+}
+
+func TestProcessInputFileFilterError(t *testing.T) {
+	content := "FTEE !false /tmp/ftee_filter_err_test.txt\n" +
+		"ignored\n"
+	tmpin := "/tmp/ftee_filter_err_test_input.txt"
+	if err := os.WriteFile(tmpin, []byte(content), 0644); err != nil {
+		t.Fatalf("Unexpected error writing %q: %q", tmpin, err)
+	}
+	defer os.Remove(tmpin)
+	defer os.Remove("/tmp/ftee_filter_err_test.txt")
+
+	infd, err := os.Open(tmpin)
+	if err != nil {
+		t.Fatalf("Unexpected error opening %q: %q", tmpin, err)
+	}
+	err = processInputFile(context.Background(), infd, "FTEE", "--end")
+	closeOutputFiles()
+	key, _ := targetKey(outputTarget{name: "/tmp/ftee_filter_err_test.txt"})
+	delete(_gOutputs, key)
+	delete(_gModes, key)
+	if err == nil {
+		t.Errorf("Expected an error from a filter that exits non-zero")
+	}
+}
+
+func TestOpenOutputFilesSubprocess(t *testing.T) {
+	targets := []outputTarget{{name: "|cat >/tmp/ftee_subprocess_test.txt"}}
+	err := openOutputFiles(targets)
+	if err != nil {
+		t.Errorf("Unexpected error: %q", err)
+	}
+	if len(_gProcesses) != 1 {
+		t.Errorf("Expected 1 running subprocess, got %d", len(_gProcesses))
+	}
+	if err = closeOutputFiles(); err != nil {
+		t.Errorf("Unexpected error waiting for subprocess: %q", err)
+	}
+	for _, target := range targets {
+		key, _ := targetKey(target)
+		delete(_gOutputs, key)
+		delete(_gProcesses, key)
+	}
+	os.Remove("/tmp/ftee_subprocess_test.txt")
+}
+
 func TestOpenOutputFiles(t *testing.T) {
-	//outputs := make(map[string]*os.File)
-	names := []string{"/tmp/foo.txt", "/tmp/bar.txt"}
-	err := openOutputFiles(names)
+	targets := []outputTarget{{name: "/tmp/foo.txt"}, {name: "/tmp/bar.txt"}}
+	err := openOutputFiles(targets)
 	if err != nil {
 		t.Errorf("Unexpected error: %q", err)
 	}
 	if len(_gOutputs) != 2 {
 		t.Errorf("Expected 2 opened files, got %d", len(_gOutputs))
 	}
-	err = openOutputFiles(names)
+	err = openOutputFiles(targets)
 	if err != nil {
 		t.Errorf("Unexpected error: %q", err)
 	}
@@ -68,6 +262,210 @@ func TestOpenOutputFiles(t *testing.T) {
 	removeOutputFiles()
 }
 
+func TestOpenOutputFilesAppendAndExistsOnly(t *testing.T) {
+	name := "/tmp/ftee_append_test.txt"
+	defer os.Remove(name)
+
+	// modeExistsOnly must fail if the file doesn't exist yet.
+	err := openOutputFiles([]outputTarget{{name: name, mode: modeExistsOnly}})
+	if err == nil {
+		t.Errorf("Expected error opening nonexistent file with modeExistsOnly")
+	}
+
+	// Create the file with some content, then reopen it with modeAppend and
+	// confirm the existing content survives.
+	if err = openOutputFiles([]outputTarget{{name: name, mode: modeTruncate}}); err != nil {
+		t.Fatalf("Unexpected error: %q", err)
+	}
+	key, _ := targetKey(outputTarget{name: name})
+	getOutputWriter(key).write(context.Background(), "first\n")
+	closeOutputFiles()
+	delete(_gOutputs, key)
+	delete(_gModes, key)
+
+	if err = openOutputFiles([]outputTarget{{name: name, mode: modeAppend}}); err != nil {
+		t.Fatalf("Unexpected error: %q", err)
+	}
+	getOutputWriter(key).write(context.Background(), "second\n")
+	closeOutputFiles()
+	delete(_gOutputs, key)
+	delete(_gModes, key)
+
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Unexpected error reading %q: %q", name, err)
+	}
+	if string(got) != "first\nsecond\n" {
+		t.Errorf("Expected appended content, got %q", got)
+	}
+}
+
+func TestOpenOutputFilesModeMismatch(t *testing.T) {
+	name := "/tmp/ftee_mode_mismatch_test.txt"
+	defer os.Remove(name)
+
+	if err := openOutputFiles([]outputTarget{{name: name, mode: modeTruncate}}); err != nil {
+		t.Fatalf("Unexpected error: %q", err)
+	}
+	err := openOutputFiles([]outputTarget{{name: name, mode: modeAppend}})
+	if err == nil {
+		t.Errorf("Expected error reopening %q with a conflicting write mode", name)
+	}
+	closeOutputFiles()
+	key, _ := targetKey(outputTarget{name: name})
+	delete(_gOutputs, key)
+	delete(_gModes, key)
+}
+
+func TestOpenOutputFilesMkdirs(t *testing.T) {
+	root := "/tmp/ftee_mkdirs_test"
+	os.RemoveAll(root)
+	name := root + "/a/b/out.txt"
+
+	_gMkdirs = true
+	defer func() { _gMkdirs = false }()
+
+	err := openOutputFiles([]outputTarget{{name: name}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %q", err)
+	}
+	if !_gCreatedDirs[root] {
+		t.Errorf("Expected %q recorded as created, got %v", root, _gCreatedDirs)
+	}
+	closeOutputFiles()
+	removeOutputFiles()
+	delete(_gOutputs, mustKey(t, name))
+	delete(_gModes, mustKey(t, name))
+	delete(_gCreatedDirs, root)
+
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("Expected %q to be removed, got err=%v", root, err)
+	}
+}
+
+func TestOpenOutputFilesMkdirsLeavesExistingDir(t *testing.T) {
+	root := "/tmp/ftee_mkdirs_existing_test"
+	os.RemoveAll(root)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatalf("Unexpected error creating %q: %q", root, err)
+	}
+	defer os.RemoveAll(root)
+	name := root + "/a/out.txt"
+
+	_gMkdirs = true
+	defer func() { _gMkdirs = false }()
+
+	err := openOutputFiles([]outputTarget{{name: name}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %q", err)
+	}
+	if _gCreatedDirs[root] {
+		t.Errorf("Didn't expect pre-existing %q recorded as created", root)
+	}
+	closeOutputFiles()
+	removeOutputFiles()
+	delete(_gOutputs, mustKey(t, name))
+	delete(_gModes, mustKey(t, name))
+	delete(_gCreatedDirs, root+"/a")
+
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("Expected pre-existing %q to survive, got err=%v", root, err)
+	}
+}
+
+func TestOpenOutputFilesDirectoryTarget(t *testing.T) {
+	root := "/tmp/ftee_section_test"
+	os.RemoveAll(root)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatalf("Unexpected error creating %q: %q", root, err)
+	}
+	defer os.RemoveAll(root)
+
+	targets1 := []outputTarget{{name: root + "/"}}
+	if err := openOutputFiles(targets1); err != nil {
+		t.Fatalf("Unexpected error: %q", err)
+	}
+	targets2 := []outputTarget{{name: root + "/"}}
+	if err := openOutputFiles(targets2); err != nil {
+		t.Fatalf("Unexpected error: %q", err)
+	}
+	if targets1[0].name == targets2[0].name {
+		t.Errorf("Expected distinct auto-named files, both got %q", targets1[0].name)
+	}
+	if filepath.Base(targets1[0].name) != "section-0001.txt" {
+		t.Errorf("Expected section-0001.txt, got %q", targets1[0].name)
+	}
+	if filepath.Base(targets2[0].name) != "section-0002.txt" {
+		t.Errorf("Expected section-0002.txt, got %q", targets2[0].name)
+	}
+	closeOutputFiles()
+	for _, targets := range [][]outputTarget{targets1, targets2} {
+		key := mustKey(t, targets[0].name)
+		delete(_gOutputs, key)
+		delete(_gModes, key)
+	}
+	delete(_gSectionCounters, mustKey(t, root))
+}
+
+// mustKey resolves name's targetKey, failing the test if resolution errors.
+func mustKey(t *testing.T, name string) string {
+	t.Helper()
+	key, err := targetKey(outputTarget{name: name})
+	if err != nil {
+		t.Fatalf("Unexpected error resolving key for %q: %q", name, err)
+	}
+	return key
+}
+
+func TestProcessInputFileConcurrentWriters(t *testing.T) {
+	name := "/tmp/ftee_concurrent_test.txt"
+	defer os.Remove(name)
+	key, _ := targetKey(outputTarget{name: name})
+
+	ctx := context.Background()
+	const writers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		content := fmt.Sprintf("FTEE >>%s\nline from writer %d\n", name, i)
+		tmpin := fmt.Sprintf("/tmp/ftee_concurrent_test_input_%d.txt", i)
+		if err := os.WriteFile(tmpin, []byte(content), 0644); err != nil {
+			t.Fatalf("Unexpected error writing %q: %q", tmpin, err)
+		}
+		defer os.Remove(tmpin)
+
+		wg.Add(1)
+		go func(tmpin string) {
+			defer wg.Done()
+			infd, err := os.Open(tmpin)
+			if err != nil {
+				t.Errorf("Unexpected error opening %q: %q", tmpin, err)
+				return
+			}
+			if err = processInputFile(ctx, infd, "FTEE", "--end"); err != nil {
+				t.Errorf("Unexpected error: %q", err)
+			}
+		}(tmpin)
+	}
+	wg.Wait()
+	closeOutputFiles()
+	delete(_gOutputs, key)
+	delete(_gModes, key)
+
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Unexpected error reading %q: %q", name, err)
+	}
+	lines := strings.Split(strings.TrimRight(string(got), "\n"), "\n")
+	if len(lines) != writers {
+		t.Errorf("Expected %d lines, got %d: %q", writers, len(lines), got)
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "line from writer ") {
+			t.Errorf("Line %q was corrupted by concurrent writes", line)
+		}
+	}
+}
+
 func BenchmarkProcessInputFile(b *testing.B) {
 	// includes file I/O
 	for n := 0; n < b.N; n++ {
@@ -76,7 +474,7 @@ func BenchmarkProcessInputFile(b *testing.B) {
 			err = fmt.Errorf("Couldn't open input file: %q", err)
 			return
 		}
-		processInputFile(infd, "FTEE")
+		processInputFile(context.Background(), infd, "FTEE", "--end")
 		infd.Close()
 		removeOutputFiles()
 	}